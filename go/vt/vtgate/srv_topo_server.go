@@ -6,18 +6,26 @@ package vtgate
 
 import (
 	"flag"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/golang/glog"
 
 	"github.com/youtube/vitess/go/stats"
+	"github.com/youtube/vitess/go/vt/concurrency"
 	"github.com/youtube/vitess/go/vt/health"
 	"github.com/youtube/vitess/go/vt/topo"
 )
 
 var (
-	srvTopoCacheTTL = flag.Duration("srv_topo_cache_ttl", 1*time.Second, "how long to use cached entries for topology")
+	srvTopoCacheTTL          = flag.Duration("srv_topo_cache_ttl", 1*time.Second, "how long to use cached entries for topology")
+	srvTopoNegativeCacheTTL  = flag.Duration("srv_topo_negative_cache_ttl", 1*time.Second, "how long to cache NotFound errors for topology before trying again")
+	srvTopoMultiConcurrency  = flag.Int("srv_topo_multi_concurrency", 32, "how many concurrent GetEndPoints calls GetEndPointsMulti may have in flight at once")
+	endPointHealthScorerName = flag.String("endpoint_health_scorer", "strict", "name of the registered EndPointHealthScorer used to weight and filter endpoints returned by GetEndPoints")
 )
 
 const (
@@ -26,6 +34,290 @@ const (
 	errorCategory  = "error"
 )
 
+const (
+	watchRetryMinBackoff = 100 * time.Millisecond
+	watchRetryMaxBackoff = 30 * time.Second
+)
+
+// FetchFunc retrieves the authoritative value for a cache key from the
+// underlying SrvTopoServer. A Cache calls it at most once per cold miss,
+// even when many goroutines ask for the same key concurrently.
+type FetchFunc func() (interface{}, error)
+
+// Cache is the pluggable backend behind each of ResilientSrvTopoServer's
+// per-key caches (srvKeyspaceNames, srvKeyspace, endPoints). It owns TTL
+// expiry, negative caching of NotFound errors, single-flight coalescing
+// of concurrent cold misses, and background refresh of hot entries. The
+// default implementation (NewTimeoutCache) is purely in-process; other
+// implementations, e.g. one backed by a shared memcache or etcd
+// instance, can be injected via NewResilientSrvTopoServerWithCache.
+type Cache interface {
+	// Get returns the value for key, calling fetch to populate or
+	// refresh the entry as needed. If fetch fails and a stale value is
+	// on hand, Get returns the stale value; whether the fetch error is
+	// returned with it depends on the implementation (TimeoutCache
+	// returns the stale value with a nil error).
+	Get(key string, fetch FetchFunc) (interface{}, error)
+}
+
+// WatchUpdate is a single notification from a WatchStartFunc's channel:
+// either a freshly pushed Value, or an Err if the watch itself failed
+// (the channel is closed right after an Err is delivered).
+type WatchUpdate struct {
+	Value interface{}
+	Err   error
+}
+
+// WatchStartFunc starts a push-based watch for key and returns a channel
+// of updates plus a cancel function. It returns an error if the
+// underlying topo implementation doesn't support watching this key, in
+// which case the TimeoutCache falls back to TTL polling for that key.
+type WatchStartFunc func(key string) (updates <-chan WatchUpdate, cancel func(), err error)
+
+// TimeoutCache is the default in-process Cache. Concurrent cold misses
+// on the same key are coalesced into a single call to fetch, entries
+// past half their TTL trigger an asynchronous background refresh so
+// foreground callers never block on topo latency, and NotFound errors
+// are cached under a separate, typically shorter, negativeTTL so a
+// missing keyspace or shard doesn't generate one topo call per request.
+//
+// If watch is non-nil, TimeoutCache additionally subscribes once per
+// cache key and updates the entry in place as notifications arrive,
+// falling back to TTL polling (srv_topo_cache_ttl) only as a safety net
+// for keys the backend can't or won't watch. Reads of a watched entry
+// don't take the entry's own mutex: after the key lookup, which holds the
+// cache-wide mutex, they are a single atomic.Value load. They are not
+// lock-free.
+type TimeoutCache struct {
+	category    string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	counts      *stats.Counters
+	watch       WatchStartFunc
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	mu sync.Mutex
+
+	insertionTime time.Time
+	value         interface{}
+	err           error
+	negative      bool
+
+	// inFlight is non-nil while a fetch for this entry is in progress;
+	// concurrent callers wait on it instead of issuing their own fetch.
+	inFlight chan struct{}
+
+	// refreshing is true while a background refresh is in flight, so we
+	// never start more than one at a time for the same entry.
+	refreshing bool
+
+	// snapshot holds the last-known-good *watchSnapshot once a
+	// WatchStartFunc watcher has taken over this entry. Its presence is
+	// what tells Get to take the lock-free watch fast path instead of
+	// the TTL path below.
+	snapshot atomic.Value
+}
+
+// watchSnapshot is what cacheEntry.snapshot holds once a watch is active.
+type watchSnapshot struct {
+	value interface{}
+	err   error
+}
+
+// NewTimeoutCache creates an in-process Cache. counts may be nil, in
+// which case no stats are recorded.
+func NewTimeoutCache(category string, ttl, negativeTTL time.Duration, counts *stats.Counters) *TimeoutCache {
+	return &TimeoutCache{
+		category:    category,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		counts:      counts,
+		entries:     make(map[string]*cacheEntry),
+	}
+}
+
+func (c *TimeoutCache) add(name string, delta int64) {
+	if c.counts != nil {
+		c.counts.Add(c.category+"."+name, delta)
+	}
+}
+
+// Get implements Cache.
+func (c *TimeoutCache) Get(key string, fetch FetchFunc) (interface{}, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cacheEntry{}
+		c.entries[key] = entry
+		if c.watch != nil {
+			go c.startWatching(key, entry)
+		}
+	}
+	c.mu.Unlock()
+
+	// fast path: a watcher owns this entry and is keeping snapshot up
+	// to date, so there's nothing to wait on and entry.mu isn't taken.
+	if snap, ok := entry.snapshot.Load().(*watchSnapshot); ok {
+		c.add("Hits", 1)
+		return snap.value, snap.err
+	}
+
+	entry.mu.Lock()
+
+	ttl := c.ttl
+	if entry.negative {
+		ttl = c.negativeTTL
+	}
+	fresh := !entry.insertionTime.IsZero() && time.Now().Sub(entry.insertionTime) < ttl
+
+	if fresh {
+		c.add("Hits", 1)
+		if !entry.negative && !entry.refreshing && time.Now().Sub(entry.insertionTime) > ttl/2 {
+			entry.refreshing = true
+			go c.refresh(key, entry, fetch)
+		}
+		value, err := entry.value, entry.err
+		entry.mu.Unlock()
+		return value, err
+	}
+
+	if entry.inFlight != nil {
+		// someone else is already fetching this key: wait for them
+		// instead of issuing a second upstream call.
+		wait := entry.inFlight
+		entry.mu.Unlock()
+		c.add("Coalesced", 1)
+		<-wait
+		entry.mu.Lock()
+		value, err := entry.value, entry.err
+		entry.mu.Unlock()
+		return value, err
+	}
+
+	c.add("Misses", 1)
+	done := make(chan struct{})
+	entry.inFlight = done
+	entry.mu.Unlock()
+
+	value, err := fetch()
+
+	entry.mu.Lock()
+	c.store(entry, value, err)
+	entry.inFlight = nil
+	entry.mu.Unlock()
+	close(done)
+
+	return entry.value, entry.err
+}
+
+// store records the outcome of a fetch on entry, handling the
+// stale-on-error and negative-caching cases. Callers must hold entry.mu.
+func (c *TimeoutCache) store(entry *cacheEntry, value interface{}, err error) {
+	if err != nil {
+		if err == topo.ErrNoNode && (entry.insertionTime.IsZero() || entry.negative) {
+			// negative-cache whenever there's no positive value to
+			// preserve: either the entry is empty, or it's already
+			// negative-cached and negativeTTL just lapsed. A prior good
+			// value still takes precedence over ErrNoNode, since a real
+			// topo backend can surface it transiently (e.g. during a
+			// resharding/keyspace transition) and not just on permanent
+			// deletion.
+			c.add("Negative", 1)
+			entry.insertionTime = time.Now()
+			entry.value = nil
+			entry.err = err
+			entry.negative = true
+			return
+		}
+		if entry.insertionTime.IsZero() {
+			// nothing to fall back on
+			entry.err = err
+			return
+		}
+		// keep serving the stale value, don't touch insertionTime
+		c.add("StaleServed", 1)
+		return
+	}
+
+	entry.insertionTime = time.Now()
+	entry.value = value
+	entry.err = nil
+	entry.negative = false
+}
+
+// refresh re-fetches key out-of-band once an entry is past half its TTL,
+// so the next foreground Get finds a fresh value without waiting on
+// topo latency itself.
+func (c *TimeoutCache) refresh(key string, entry *cacheEntry, fetch FetchFunc) {
+	value, err := fetch()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.refreshing = false
+	if err != nil {
+		c.add("StaleServed", 1)
+		log.Warningf("%v: background refresh of %v failed: %v (keeping cached value)", c.category, key, err)
+		return
+	}
+	c.add("Refreshed", 1)
+	entry.insertionTime = time.Now()
+	entry.value = value
+	entry.err = nil
+	entry.negative = false
+}
+
+// startWatching subscribes to key via c.watch and keeps entry.snapshot
+// up to date as notifications arrive. If c.watch fails before any
+// snapshot has been stored, it returns immediately and entry is left to
+// the regular TTL path in Get. Once a snapshot is stored, a disconnect or
+// a failed re-watch is retried with exponential backoff, and an Err
+// update leaves the snapshot untouched, so the last snapshot keeps being
+// served (stale-on-error), exactly like the TTL path.
+func (c *TimeoutCache) startWatching(key string, entry *cacheEntry) {
+	backoff := watchRetryMinBackoff
+	for {
+		updates, cancel, err := c.watch(key)
+		if err != nil {
+			if entry.snapshot.Load() == nil {
+				log.Warningf("%v: watch(%v) unavailable, falling back to TTL polling: %v", c.category, key, err)
+				return
+			}
+			// Get no longer polls this entry, so keep retrying
+			log.Warningf("%v: watch(%v) failed, retrying in %v (serving last known value meanwhile): %v", c.category, key, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > watchRetryMaxBackoff {
+				backoff = watchRetryMaxBackoff
+			}
+			continue
+		}
+
+		for update := range updates {
+			backoff = watchRetryMinBackoff
+			if update.Err != nil {
+				// keep serving the last known good snapshot
+				c.add("StaleServed", 1)
+				continue
+			}
+			c.add("Refreshed", 1)
+			entry.snapshot.Store(&watchSnapshot{value: update.Value, err: update.Err})
+		}
+		cancel()
+
+		c.add("StaleServed", 1)
+		log.Warningf("%v: watch(%v) disconnected, retrying in %v (serving last known value meanwhile)", c.category, key, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > watchRetryMaxBackoff {
+			backoff = watchRetryMaxBackoff
+		}
+	}
+}
+
 // SrvTopoServer is a subset of topo.Server that only contains the serving
 // graph read-only calls used by clients to resolve serving addresses.
 type SrvTopoServer interface {
@@ -36,6 +328,29 @@ type SrvTopoServer interface {
 	GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error)
 }
 
+// SrvKeyspaceWatcher is an optional extension to SrvTopoServer,
+// implemented by backends that can push change notifications for a
+// keyspace's serving graph instead of being polled. ResilientSrvTopoServer
+// type-asserts its underlying SrvTopoServer against this interface and,
+// when present, subscribes once per (cell, keyspace) instead of relying
+// on srv_topo_cache_ttl.
+type SrvKeyspaceWatcher interface {
+	// WatchSrvKeyspace returns a channel that receives the current
+	// value of the given keyspace's serving graph every time it
+	// changes, and a cancel function to stop watching. The channel is
+	// closed if the watch fails and cannot be retried internally.
+	WatchSrvKeyspace(cell, keyspace string) (current <-chan *topo.SrvKeyspace, cancel func(), err error)
+}
+
+// EndPointsWatcher is the WatchSrvKeyspace-style optional extension for a
+// shard's endpoints.
+type EndPointsWatcher interface {
+	// WatchEndPoints returns a channel that receives the current
+	// endpoints for (cell, keyspace, shard, tabletType) every time they
+	// change, and a cancel function to stop watching.
+	WatchEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (current <-chan *topo.EndPoints, cancel func(), err error)
+}
+
 // ResilientSrvTopoServer is an implementation of SrvTopoServer based
 // on another SrvTopoServer that uses a cache for two purposes:
 // - limit the QPS to the underlying SrvTopoServer
@@ -44,209 +359,410 @@ type ResilientSrvTopoServer struct {
 	topoServer SrvTopoServer
 	counts     *stats.Counters
 
-	// mu protects the cache map itself, not the individual values
-	// in the cache.
-	mutex                 sync.Mutex
-	srvKeyspaceNamesCache map[string]*srvKeyspaceNamesEntry
-	srvKeyspaceCache      map[string]*srvKeyspaceEntry
-	endPointsCache        map[string]*endPointsEntry
+	srvKeyspaceNamesCache Cache
+	srvKeyspaceCache      Cache
+	endPointsCache        Cache
 }
 
-type srvKeyspaceNamesEntry struct {
-	// the mutex protects any access to this structure (read or write)
-	mutex sync.Mutex
+// NewResilientSrvTopoServer creates a new ResilientSrvTopoServer based on
+// the provided SrvTopoServer, using the default in-process TimeoutCache
+// for all three categories. If base implements SrvKeyspaceWatcher and/or
+// EndPointsWatcher, the corresponding cache subscribes to push
+// notifications instead of relying on srv_topo_cache_ttl polling.
+func NewResilientSrvTopoServer(base SrvTopoServer) *ResilientSrvTopoServer {
+	counts := stats.NewCounters("ResilientSrvTopoServerCounts")
 
-	insertionTime time.Time
-	value         []string
+	srvKeyspaceCache := NewTimeoutCache("SrvKeyspace", *srvTopoCacheTTL, *srvTopoNegativeCacheTTL, counts)
+	srvKeyspaceCache.watch = srvKeyspaceWatchFunc(base)
+
+	endPointsCache := NewTimeoutCache("EndPoints", *srvTopoCacheTTL, *srvTopoNegativeCacheTTL, counts)
+	endPointsCache.watch = endPointsWatchFunc(base)
+
+	return NewResilientSrvTopoServerWithCache(
+		base,
+		NewTimeoutCache("SrvKeyspaceNames", *srvTopoCacheTTL, *srvTopoNegativeCacheTTL, counts),
+		srvKeyspaceCache,
+		endPointsCache,
+		counts,
+	)
+}
+
+// srvKeyspaceWatchFunc builds the WatchStartFunc for the srvKeyspace
+// cache, or nil if base doesn't support watching. key is "cell:keyspace",
+// matching GetSrvKeyspace's own cache key.
+func srvKeyspaceWatchFunc(base SrvTopoServer) WatchStartFunc {
+	watcher, ok := base.(SrvKeyspaceWatcher)
+	if !ok {
+		return nil
+	}
+	return func(key string) (<-chan WatchUpdate, func(), error) {
+		cell, keyspace, err := splitTwo(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		current, cancel, err := watcher.WatchSrvKeyspace(cell, keyspace)
+		if err != nil {
+			return nil, nil, err
+		}
+		return relayWatch(current, func(value interface{}) interface{} { return value }), cancel, nil
+	}
 }
 
-type srvKeyspaceEntry struct {
-	// the mutex protects any access to this structure (read or write)
-	mutex sync.Mutex
+// endPointsWatchFunc builds the WatchStartFunc for the endPoints cache,
+// or nil if base doesn't support watching. key is
+// "cell:keyspace:shard:tabletType", matching GetEndPoints' own cache key.
+func endPointsWatchFunc(base SrvTopoServer) WatchStartFunc {
+	watcher, ok := base.(EndPointsWatcher)
+	if !ok {
+		return nil
+	}
+	return func(key string) (<-chan WatchUpdate, func(), error) {
+		cell, keyspace, shard, tabletType, err := splitFour(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		current, cancel, err := watcher.WatchEndPoints(cell, keyspace, shard, tabletType)
+		if err != nil {
+			return nil, nil, err
+		}
+		return relayWatch(current, func(value interface{}) interface{} {
+			endPoints, scored := scoreEndPoints(value.(*topo.EndPoints), lookupEndPointHealthScorer(*endPointHealthScorerName))
+			return &scoredEndPointsCacheValue{endPoints: endPoints, scored: scored}
+		}), cancel, nil
+	}
+}
 
-	insertionTime time.Time
-	value         *topo.SrvKeyspace
+// relayWatch adapts a topo-typed watch channel (closed on failure, no
+// separate error signal) into the generic WatchUpdate channel TimeoutCache
+// consumes. Each pushed value is run through wrap so it ends up in the
+// same representation the cache's FetchFunc would have produced, since
+// the ResilientSrvTopoServer Get methods type-assert cached values
+// identically whether they came from the TTL or the watch path.
+func relayWatch(current interface{}, wrap func(interface{}) interface{}) <-chan WatchUpdate {
+	updates := make(chan WatchUpdate)
+	go func() {
+		defer close(updates)
+		switch ch := current.(type) {
+		case <-chan *topo.SrvKeyspace:
+			for value := range ch {
+				updates <- WatchUpdate{Value: wrap(value)}
+			}
+		case <-chan *topo.EndPoints:
+			for value := range ch {
+				updates <- WatchUpdate{Value: wrap(value)}
+			}
+		}
+	}()
+	return updates
 }
 
-type endPointsEntry struct {
-	// the mutex protects any access to this structure (read or write)
-	mutex sync.Mutex
+// splitTwo parses a "cell:keyspace" cache key.
+func splitTwo(key string) (cell, keyspace string, err error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("malformed cache key %q", key)
+	}
+	return parts[0], parts[1], nil
+}
 
-	insertionTime time.Time
-	value         *topo.EndPoints
+// splitFour parses a "cell:keyspace:shard:tabletType" cache key.
+func splitFour(key string) (cell, keyspace, shard string, tabletType topo.TabletType, err error) {
+	parts := strings.SplitN(key, ":", 4)
+	if len(parts) != 4 {
+		return "", "", "", "", fmt.Errorf("malformed cache key %q", key)
+	}
+	return parts[0], parts[1], parts[2], topo.TabletType(parts[3]), nil
 }
 
-// NewResilientSrvTopoServer creates a new ResilientSrvTopoServer
-// based on the provided SrvTopoServer.
-func NewResilientSrvTopoServer(base SrvTopoServer) *ResilientSrvTopoServer {
+// NewResilientSrvTopoServerWithCache is like NewResilientSrvTopoServer but
+// lets each per-category cache be swapped for an alternate Cache
+// implementation, e.g. one backed by a shared memcache or etcd instance.
+func NewResilientSrvTopoServerWithCache(base SrvTopoServer, srvKeyspaceNamesCache, srvKeyspaceCache, endPointsCache Cache, counts *stats.Counters) *ResilientSrvTopoServer {
 	return &ResilientSrvTopoServer{
 		topoServer: base,
-		counts:     stats.NewCounters("ResilientSrvTopoServerCounts"),
+		counts:     counts,
 
-		srvKeyspaceNamesCache: make(map[string]*srvKeyspaceNamesEntry),
-		srvKeyspaceCache:      make(map[string]*srvKeyspaceEntry),
-		endPointsCache:        make(map[string]*endPointsEntry),
+		srvKeyspaceNamesCache: srvKeyspaceNamesCache,
+		srvKeyspaceCache:      srvKeyspaceCache,
+		endPointsCache:        endPointsCache,
 	}
 }
 
 func (server *ResilientSrvTopoServer) GetSrvKeyspaceNames(cell string) ([]string, error) {
 	server.counts.Add(queryCategory, 1)
 
-	// find the entry in the cache, add it if not there
 	key := cell
-	server.mutex.Lock()
-	entry, ok := server.srvKeyspaceNamesCache[key]
-	if !ok {
-		entry = &srvKeyspaceNamesEntry{}
-		server.srvKeyspaceNamesCache[key] = entry
+	value, err := server.srvKeyspaceNamesCache.Get(key, func() (interface{}, error) {
+		return server.topoServer.GetSrvKeyspaceNames(cell)
+	})
+
+	switch {
+	case err == nil:
+		return value.([]string), nil
+	case err == topo.ErrNoNode:
+		return nil, err
+	case value != nil:
+		server.counts.Add(cachedCategory, 1)
+		log.Warningf("GetSrvKeyspaceNames(%v) failed: %v (returning cached value)", cell, err)
+		return value.([]string), nil
+	default:
+		server.counts.Add(errorCategory, 1)
+		log.Errorf("GetSrvKeyspaceNames(%v) failed: %v (no cached value, returning error)", cell, err)
+		return nil, err
 	}
-	server.mutex.Unlock()
+}
 
-	// Lock the entry, and do everything holding the lock.  This
-	// means two concurrent requests will only issue one
-	// underlying query.
-	entry.mutex.Lock()
-	defer entry.mutex.Unlock()
+func (server *ResilientSrvTopoServer) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
+	server.counts.Add(queryCategory, 1)
 
-	// If the entry is fresh enough, return it
-	if time.Now().Sub(entry.insertionTime) < *srvTopoCacheTTL {
-		return entry.value, nil
+	key := cell + ":" + keyspace
+	value, err := server.srvKeyspaceCache.Get(key, func() (interface{}, error) {
+		return server.topoServer.GetSrvKeyspace(cell, keyspace)
+	})
+
+	switch {
+	case err == nil:
+		return value.(*topo.SrvKeyspace), nil
+	case err == topo.ErrNoNode:
+		return nil, err
+	case value != nil:
+		server.counts.Add(cachedCategory, 1)
+		log.Warningf("GetSrvKeyspace(%v, %v) failed: %v (returning cached value)", cell, keyspace, err)
+		return value.(*topo.SrvKeyspace), nil
+	default:
+		server.counts.Add(errorCategory, 1)
+		log.Errorf("GetSrvKeyspace(%v, %v) failed: %v (no cached value, returning error)", cell, keyspace, err)
+		return nil, err
 	}
+}
 
-	// not in cache or too old, get the real value
-	result, err := server.topoServer.GetSrvKeyspaceNames(cell)
-	if err != nil {
-		if entry.insertionTime.IsZero() {
-			server.counts.Add(errorCategory, 1)
-			log.Errorf("GetSrvKeyspaceNames(%v) failed: %v (no cached value, returning error)", cell, err)
+// GetEndPoints returns the endpoints for (cell, keyspace, shard,
+// tabletType), sorted by descending weight under the configured
+// EndPointHealthScorer (see -endpoint_health_scorer). Callers that want
+// the weights themselves, e.g. to do weighted random or P2C selection
+// rather than picking uniformly from the front of the list, should use
+// GetEndPointsScored instead.
+func (server *ResilientSrvTopoServer) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	endPoints, _, err := server.getEndPoints(cell, keyspace, shard, tabletType)
+	return endPoints, err
+}
+
+// GetEndPointsScored is like GetEndPoints but also returns the per-endpoint
+// weights the configured EndPointHealthScorer assigned, in the same order
+// as EndPoints.Entries.
+func (server *ResilientSrvTopoServer) GetEndPointsScored(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, []ScoredEndPoint, error) {
+	return server.getEndPoints(cell, keyspace, shard, tabletType)
+}
+
+func (server *ResilientSrvTopoServer) getEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, []ScoredEndPoint, error) {
+	server.counts.Add(queryCategory, 1)
+
+	key := cell + ":" + keyspace + ":" + shard + ":" + string(tabletType)
+	value, err := server.endPointsCache.Get(key, func() (interface{}, error) {
+		result, err := server.topoServer.GetEndPoints(cell, keyspace, shard, tabletType)
+		if err != nil {
 			return nil, err
-		} else {
-			server.counts.Add(cachedCategory, 1)
-			log.Warningf("GetSrvKeyspaceNames(%v) failed: %v (returning cached value)", cell, err)
-			return entry.value, nil
 		}
+		endPoints, scored := scoreEndPoints(result, lookupEndPointHealthScorer(*endPointHealthScorerName))
+		return &scoredEndPointsCacheValue{endPoints: endPoints, scored: scored}, nil
+	})
+
+	switch {
+	case err == nil:
+		v := value.(*scoredEndPointsCacheValue)
+		return v.endPoints, v.scored, nil
+	case err == topo.ErrNoNode:
+		return nil, nil, err
+	case value != nil:
+		server.counts.Add(cachedCategory, 1)
+		log.Warningf("GetEndPoints(%v, %v, %v, %v) failed: %v (returning cached value)", cell, keyspace, shard, tabletType, err)
+		v := value.(*scoredEndPointsCacheValue)
+		return v.endPoints, v.scored, nil
+	default:
+		server.counts.Add(errorCategory, 1)
+		log.Errorf("GetEndPoints(%v, %v, %v, %v) failed: %v (no cached value, returning error)", cell, keyspace, shard, tabletType, err)
+		return nil, nil, err
 	}
+}
 
-	// save the value we got and the current time in the cache
-	entry.insertionTime = time.Now()
-	entry.value = result
-	return result, nil
+// scoredEndPointsCacheValue is what the endPoints Cache actually stores:
+// the filtered/sorted endpoints together with the weights that produced
+// that ordering, so GetEndPointsScored doesn't have to re-score on every
+// cache hit.
+type scoredEndPointsCacheValue struct {
+	endPoints *topo.EndPoints
+	scored    []ScoredEndPoint
 }
 
-func (server *ResilientSrvTopoServer) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
-	server.counts.Add(queryCategory, 1)
+// EndPointRequest identifies a single (cell, keyspace, shard, tabletType)
+// target to resolve as part of a GetEndPointsMulti call.
+type EndPointRequest struct {
+	Cell       string
+	Keyspace   string
+	Shard      string
+	TabletType topo.TabletType
+}
 
-	// find the entry in the cache, add it if not there
-	key := cell + ":" + keyspace
-	server.mutex.Lock()
-	entry, ok := server.srvKeyspaceCache[key]
-	if !ok {
-		entry = &srvKeyspaceEntry{}
-		server.srvKeyspaceCache[key] = entry
-	}
-	server.mutex.Unlock()
+// String implements fmt.Stringer so a failed EndPointRequest can be
+// identified in an aggregated error message.
+func (r EndPointRequest) String() string {
+	return fmt.Sprintf("%v/%v/%v/%v", r.Cell, r.Keyspace, r.Shard, r.TabletType)
+}
 
-	// Lock the entry, and do everything holding the lock.  This
-	// means two concurrent requests will only issue one
-	// underlying query.
-	entry.mutex.Lock()
-	defer entry.mutex.Unlock()
+// EndPointsResult is the outcome of resolving one EndPointRequest as part
+// of a GetEndPointsMulti call: either EndPoints is populated, or Err is,
+// never both.
+type EndPointsResult struct {
+	Request   EndPointRequest
+	EndPoints *topo.EndPoints
+	Err       error
+}
 
-	// If the entry is fresh enough, return it
-	if time.Now().Sub(entry.insertionTime) < *srvTopoCacheTTL {
-		return entry.value, nil
+// multiConcurrency returns the configured -srv_topo_multi_concurrency,
+// clamped to at least 1. The flag is operator-facing and a value of 0
+// would deadlock GetEndPointsMulti forever (every goroutine blocks on
+// the zero-capacity semaphore channel) while a negative value panics
+// the make(chan) call outright, so the raw flag value is never trusted
+// as-is.
+func multiConcurrency() int {
+	if n := *srvTopoMultiConcurrency; n > 0 {
+		return n
 	}
+	return 1
+}
 
-	// not in cache or too old, get the real value
-	result, err := server.topoServer.GetSrvKeyspace(cell, keyspace)
-	if err != nil {
-		if entry.insertionTime.IsZero() {
-			server.counts.Add(errorCategory, 1)
-			log.Errorf("GetSrvKeyspace(%v, %v) failed: %v (no cached value, returning error)", cell, keyspace, err)
-			return nil, err
-		} else {
-			server.counts.Add(cachedCategory, 1)
-			log.Warningf("GetSrvKeyspace(%v, %v) failed: %v (returning cached value)", cell, keyspace, err)
-			return entry.value, nil
-		}
+// GetEndPointsMulti resolves requests in parallel, fanning out one
+// goroutine per request bounded by -srv_topo_multi_concurrency. It never
+// aborts the batch on a single failure: it always returns one
+// EndPointsResult per request, plus a single aggregated error (built with
+// concurrency.AllErrorRecorder) enumerating every failed target, or nil
+// if all of them succeeded.
+func (server *ResilientSrvTopoServer) GetEndPointsMulti(requests []EndPointRequest) ([]EndPointsResult, error) {
+	results := make([]EndPointsResult, len(requests))
+	rec := concurrency.AllErrorRecorder{}
+
+	sem := make(chan struct{}, multiConcurrency())
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		wg.Add(1)
+		go func(i int, req EndPointRequest) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			endPoints, err := server.GetEndPoints(req.Cell, req.Keyspace, req.Shard, req.TabletType)
+			results[i] = EndPointsResult{Request: req, EndPoints: endPoints, Err: err}
+			if err != nil {
+				rec.RecordError(fmt.Errorf("%v: %v", req, err))
+			}
+		}(i, req)
 	}
+	wg.Wait()
 
-	// save the value we got and the current time in the cache
-	entry.insertionTime = time.Now()
-	entry.value = result
-	return result, nil
+	if rec.HasErrors() {
+		return results, rec.Error()
+	}
+	return results, nil
 }
 
-func (server *ResilientSrvTopoServer) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
-	server.counts.Add(queryCategory, 1)
+// EndPointHealthScorer computes a weight for an endpoint from its health
+// signals (replication lag, error rate, load, tablet type preference,
+// ...). Higher is healthier; a weight of 0 means "exclude this endpoint",
+// subject to the "keep all if all unhealthy" invariant applied by
+// scoreEndPoints.
+type EndPointHealthScorer func(ep topo.EndPoint) float64
+
+// ScoredEndPoint pairs a topo.EndPoint with the weight its
+// EndPointHealthScorer assigned it.
+type ScoredEndPoint struct {
+	EndPoint topo.EndPoint
+	Weight   float64
+}
 
-	// find the entry in the cache, add it if not there
-	key := cell + ":" + keyspace + ":" + shard + ":" + string(tabletType)
-	server.mutex.Lock()
-	entry, ok := server.endPointsCache[key]
-	if !ok {
-		entry = &endPointsEntry{}
-		server.endPointsCache[key] = entry
-	}
-	server.mutex.Unlock()
+var endPointHealthScorers = map[string]EndPointHealthScorer{
+	"strict": StrictEndPointHealthScorer,
+	"graded": GradedEndPointHealthScorer,
+}
 
-	// Lock the entry, and do everything holding the lock.  This
-	// means two concurrent requests will only issue one
-	// underlying query.
-	entry.mutex.Lock()
-	defer entry.mutex.Unlock()
+// RegisterEndPointHealthScorer makes a scorer selectable by name via the
+// -endpoint_health_scorer flag.
+func RegisterEndPointHealthScorer(name string, scorer EndPointHealthScorer) {
+	endPointHealthScorers[name] = scorer
+}
 
-	// If the entry is fresh enough, return it
-	if time.Now().Sub(entry.insertionTime) < *srvTopoCacheTTL {
-		return entry.value, nil
+func lookupEndPointHealthScorer(name string) EndPointHealthScorer {
+	if scorer, ok := endPointHealthScorers[name]; ok {
+		return scorer
 	}
+	log.Warningf("unknown -endpoint_health_scorer %q, falling back to strict", name)
+	return StrictEndPointHealthScorer
+}
 
-	// not in cache or too old, get the real value
-	result, err := server.topoServer.GetEndPoints(cell, keyspace, shard, tabletType)
-	if err != nil {
-		if entry.insertionTime.IsZero() {
-			server.counts.Add(errorCategory, 1)
-			log.Errorf("GetEndPoints(%v, %v, %v, %v) failed: %v (no cached value, returning error)", cell, keyspace, shard, tabletType, err)
-			return nil, err
-		} else {
-			server.counts.Add(cachedCategory, 1)
-			log.Warningf("GetEndPoints(%v, %v, %v, %v) failed: %v (returning cached value)", cell, keyspace, shard, tabletType, err)
-			return entry.value, nil
-		}
+// StrictEndPointHealthScorer is the default scorer and reproduces the
+// server's original behavior: an endpoint whose health.ReplicationLag is
+// health.ReplicationLagHigh is excluded entirely (weight 0); everything
+// else is weighted equally.
+func StrictEndPointHealthScorer(ep topo.EndPoint) float64 {
+	if ep.Health != nil && ep.Health[health.ReplicationLag] == health.ReplicationLagHigh {
+		return 0
 	}
+	return 1
+}
 
-	// filter the values to remove unhealthy servers
-	result = filterUnhealthyServers(result)
-
-	// save the value we got and the current time in the cache
-	entry.insertionTime = time.Now()
-	entry.value = result
-	return result, nil
+// gradedReplicationLagHighPenalty is how much GradedEndPointHealthScorer
+// discounts an endpoint with high replication lag, rather than excluding
+// it outright.
+const gradedReplicationLagHighPenalty = 0.1
+
+// GradedEndPointHealthScorer treats high replication lag as a heavy
+// penalty instead of outright exclusion, so a shard where every replica
+// is lagging can still serve reads at reduced weight instead of falling
+// back to "keep all".
+func GradedEndPointHealthScorer(ep topo.EndPoint) float64 {
+	weight := 1.0
+	if ep.Health != nil && ep.Health[health.ReplicationLag] == health.ReplicationLagHigh {
+		weight *= gradedReplicationLagHighPenalty
+	}
+	return weight
 }
 
-// filterUnhealthyServers removes the unhealthy servers from the list,
-// unless all servers are unhealthy, then it keeps them all.
-func filterUnhealthyServers(endPoints *topo.EndPoints) *topo.EndPoints {
+// scoreEndPoints scores every entry in endPoints with scorer and returns
+// them sorted by descending weight, dropping zero-weight entries unless
+// that would leave nothing at all, in which case all of them are kept
+// (the "keep all if all unhealthy" invariant).
+func scoreEndPoints(endPoints *topo.EndPoints, scorer EndPointHealthScorer) (*topo.EndPoints, []ScoredEndPoint) {
 	// no endpoints, return right away
 	if endPoints == nil || len(endPoints.Entries) == 0 {
-		return endPoints
+		return endPoints, nil
 	}
 
-	healthyEndPoints := make([]topo.EndPoint, 0, len(endPoints.Entries))
-	for _, ep := range endPoints.Entries {
-		// if we are behind on replication, we're not 100% healthy
-		if ep.Health != nil && ep.Health[health.ReplicationLag] == health.ReplicationLagHigh {
-			continue
-		}
+	scored := make([]ScoredEndPoint, len(endPoints.Entries))
+	for i, ep := range endPoints.Entries {
+		scored[i] = ScoredEndPoint{EndPoint: ep, Weight: scorer(ep)}
+	}
+	sort.Stable(byWeightDescending(scored))
 
-		healthyEndPoints = append(healthyEndPoints, ep)
+	healthy := make([]ScoredEndPoint, 0, len(scored))
+	for _, s := range scored {
+		if s.Weight > 0 {
+			healthy = append(healthy, s)
+		}
 	}
 
-	// we have healthy guys, we return them
-	if len(healthyEndPoints) > 0 {
-		return &topo.EndPoints{Entries: healthyEndPoints}
+	// we only have unhealthy guys, return them all
+	if len(healthy) == 0 {
+		healthy = scored
 	}
 
-	// we only have unhealthy guys, return them
-	return endPoints
+	entries := make([]topo.EndPoint, len(healthy))
+	for i, s := range healthy {
+		entries[i] = s.EndPoint
+	}
+	return &topo.EndPoints{Entries: entries}, healthy
 }
+
+type byWeightDescending []ScoredEndPoint
+
+func (s byWeightDescending) Len() int           { return len(s) }
+func (s byWeightDescending) Less(i, j int) bool { return s[i].Weight > s[j].Weight }
+func (s byWeightDescending) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,250 @@
+// Copyright 2013, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtgate
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/health"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// TestTimeoutCachePreservesStaleValueOnTransientErrNoNode verifies that a
+// topo.ErrNoNode returned after a prior successful fetch falls back to
+// serving the stale good value instead of negative-caching over it, since
+// a real topo backend can surface ErrNoNode transiently (e.g. mid
+// resharding) and not just on permanent deletion.
+func TestTimeoutCachePreservesStaleValueOnTransientErrNoNode(t *testing.T) {
+	c := NewTimeoutCache("Test", time.Nanosecond, time.Hour, nil)
+
+	value, err := c.Get("key", func() (interface{}, error) {
+		return "good-value", nil
+	})
+	if err != nil || value != "good-value" {
+		t.Fatalf("initial Get() = (%v, %v), want (good-value, nil)", value, err)
+	}
+
+	time.Sleep(time.Millisecond) // let the 1ns ttl lapse so the next Get refetches
+
+	value, _ = c.Get("key", func() (interface{}, error) {
+		return nil, topo.ErrNoNode
+	})
+	if value != "good-value" {
+		t.Errorf("Get() after transient ErrNoNode = %v, want stale good-value preserved", value)
+	}
+}
+
+// TestTimeoutCacheNegativeCachesRepeatedMisses verifies that a key which
+// genuinely never exists stays negative-cached across repeated misses,
+// refetching only once per negativeTTL window instead of on every call.
+func TestTimeoutCacheNegativeCachesRepeatedMisses(t *testing.T) {
+	c := NewTimeoutCache("Test", time.Hour, 50*time.Millisecond, nil)
+
+	var calls int32
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, topo.ErrNoNode
+	}
+
+	c.Get("missing", fetch)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("calls after first Get() = %d, want 1 (negative-cached)", got)
+	}
+
+	time.Sleep(100 * time.Millisecond) // let negativeTTL lapse
+
+	c.Get("missing", fetch)
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("calls once negativeTTL lapsed = %d, want 2 (one refetch)", got)
+	}
+
+	c.Get("missing", fetch)
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("calls after an immediate back-to-back Get() = %d, want still 2 (re-negative-cached, not refetched every call)", got)
+	}
+}
+
+// TestTimeoutCacheCoalescesConcurrentMisses verifies that concurrent cold
+// misses on the same key are coalesced into a single call to fetch.
+func TestTimeoutCacheCoalescesConcurrentMisses(t *testing.T) {
+	c := NewTimeoutCache("Test", time.Hour, time.Hour, nil)
+
+	var calls int32
+	release := make(chan struct{})
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+
+	const n = 10
+	results := make([]interface{}, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.Get("key", fetch)
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond) // let every goroutine reach the inFlight wait
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fetch called %d times for %d concurrent cold misses, want 1", got, n)
+	}
+	for i, v := range results {
+		if v != "value" {
+			t.Errorf("results[%d] = %v, want value", i, v)
+		}
+	}
+}
+
+// TestTimeoutCacheBackgroundRefreshesPastHalfTTL verifies that an entry past
+// half its TTL triggers an asynchronous refresh rather than blocking the
+// foreground Get on topo latency.
+func TestTimeoutCacheBackgroundRefreshesPastHalfTTL(t *testing.T) {
+	c := NewTimeoutCache("Test", 40*time.Millisecond, time.Hour, nil)
+
+	var calls int32
+	fetch := func() (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+
+	if v, _ := c.Get("key", fetch); v != int32(1) {
+		t.Fatalf("first Get() = %v, want 1", v)
+	}
+
+	time.Sleep(30 * time.Millisecond) // past half of the 40ms ttl, still within it
+
+	if v, _ := c.Get("key", fetch); v != int32(1) {
+		t.Fatalf("Get() past half-TTL = %v, want still 1 (background refresh triggered but not landed yet)", v)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		v, _ := c.Get("key", fetch)
+		if v == int32(2) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background refresh never landed, Get() = %v, want 2", v)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestMultiConcurrencyClampsInvalidValues verifies that GetEndPointsMulti's
+// concurrency helper never hands a zero or negative size to make(chan), since
+// -srv_topo_multi_concurrency is operator-facing: 0 would deadlock
+// GetEndPointsMulti forever and a negative value panics make(chan) outright.
+func TestMultiConcurrencyClampsInvalidValues(t *testing.T) {
+	orig := *srvTopoMultiConcurrency
+	defer func() { *srvTopoMultiConcurrency = orig }()
+
+	cases := []struct {
+		configured int
+		want       int
+	}{
+		{0, 1},
+		{-5, 1},
+		{4, 4},
+	}
+	for _, tc := range cases {
+		*srvTopoMultiConcurrency = tc.configured
+		if got := multiConcurrency(); got != tc.want {
+			t.Errorf("multiConcurrency() with flag=%d = %d, want %d", tc.configured, got, tc.want)
+		}
+	}
+}
+
+// TestScoreEndPointsDropsZeroWeightUnlessAllZero verifies that
+// scoreEndPoints filters out zero-weight (unhealthy) endpoints, unless
+// every endpoint is unhealthy, in which case it falls back to keeping
+// them all.
+func TestScoreEndPointsDropsZeroWeightUnlessAllZero(t *testing.T) {
+	lagged := topo.EndPoint{Health: map[string]string{health.ReplicationLag: health.ReplicationLagHigh}}
+	healthy := topo.EndPoint{}
+
+	endPoints, scored := scoreEndPoints(&topo.EndPoints{Entries: []topo.EndPoint{lagged, healthy}}, StrictEndPointHealthScorer)
+	if len(endPoints.Entries) != 1 {
+		t.Fatalf("scoreEndPoints() kept %d entries, want only the healthy one", len(endPoints.Entries))
+	}
+	if len(scored) != 1 || scored[0].Weight != 1 {
+		t.Fatalf("scored = %+v, want one healthy entry with weight 1", scored)
+	}
+
+	endPoints, _ = scoreEndPoints(&topo.EndPoints{Entries: []topo.EndPoint{lagged}}, StrictEndPointHealthScorer)
+	if len(endPoints.Entries) != 1 {
+		t.Fatalf("scoreEndPoints() with only unhealthy entries kept %d, want the keep-all-if-all-unhealthy fallback", len(endPoints.Entries))
+	}
+}
+
+// TestGradedEndPointHealthScorerPenalizesInsteadOfExcluding verifies that
+// GradedEndPointHealthScorer discounts a lagging endpoint's weight rather
+// than excluding it outright, unlike StrictEndPointHealthScorer.
+func TestGradedEndPointHealthScorerPenalizesInsteadOfExcluding(t *testing.T) {
+	lagged := topo.EndPoint{Health: map[string]string{health.ReplicationLag: health.ReplicationLagHigh}}
+	if got := GradedEndPointHealthScorer(lagged); got != gradedReplicationLagHighPenalty {
+		t.Errorf("GradedEndPointHealthScorer(lagged) = %v, want %v", got, gradedReplicationLagHighPenalty)
+	}
+
+	healthy := topo.EndPoint{}
+	if got := GradedEndPointHealthScorer(healthy); got != 1 {
+		t.Errorf("GradedEndPointHealthScorer(healthy) = %v, want 1", got)
+	}
+}
+
+// watchingEndPointsBase is a minimal SrvTopoServer that also implements
+// EndPointsWatcher, pushing endPoints once on the channel it returns from
+// WatchEndPoints. Its GetEndPoints always fails, so endpoints can only
+// reach the server through the watch.
+type watchingEndPointsBase struct {
+	endPoints *topo.EndPoints
+}
+
+func (b *watchingEndPointsBase) GetSrvKeyspaceNames(cell string) ([]string, error) {
+	return nil, nil
+}
+
+func (b *watchingEndPointsBase) GetSrvKeyspace(cell, keyspace string) (*topo.SrvKeyspace, error) {
+	return nil, nil
+}
+
+func (b *watchingEndPointsBase) GetEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (*topo.EndPoints, error) {
+	return nil, errors.New("GetEndPoints not served, watch only")
+}
+
+func (b *watchingEndPointsBase) WatchEndPoints(cell, keyspace, shard string, tabletType topo.TabletType) (<-chan *topo.EndPoints, func(), error) {
+	ch := make(chan *topo.EndPoints, 1)
+	ch <- b.endPoints
+	return ch, func() {}, nil
+}
+
+// TestGetEndPointsAfterWatchUpdate verifies that once a watch has pushed its
+// first update, GetEndPoints keeps returning scored endpoints instead of
+// panicking on the raw *topo.EndPoints relayWatch used to store unwrapped.
+func TestGetEndPointsAfterWatchUpdate(t *testing.T) {
+	base := &watchingEndPointsBase{endPoints: &topo.EndPoints{Entries: []topo.EndPoint{{}, {}}}}
+	server := NewResilientSrvTopoServer(base)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, _, err := server.getEndPoints("cell", "ks", "0", topo.TabletType("master"))
+		if err == nil && got != nil && len(got.Entries) == len(base.endPoints.Entries) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("watch update never surfaced correctly via GetEndPoints: got=%v, err=%v", got, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}